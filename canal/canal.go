@@ -0,0 +1,440 @@
+package canal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/siddontang/go-log/log"
+
+	"github.com/steerben/go-mysql/client"
+	"github.com/steerben/go-mysql/mysql"
+	"github.com/steerben/go-mysql/replication"
+	"github.com/steerben/go-mysql/schema"
+)
+
+// ErrExcludedTable is returned by GetTable when the requested table is
+// filtered out by Config.IncludeTableRegex/ExcludeTableRegex.
+var ErrExcludedTable = errors.New("canal: table is filtered out")
+
+// RowsEvent is the row-level change Canal hands to EventHandler.OnRow.
+// Action is one of "insert", "update" or "delete".
+type RowsEvent struct {
+	Table  *schema.Table
+	Action string
+	Rows   [][]interface{}
+}
+
+// connTarget is the MySQL instance Canal is currently talking to. It starts
+// out equal to cfg.Addr/User/Password, but a failover (ha.go) repoints it to
+// a promoted candidate; cfg itself is never mutated, so connTarget is the
+// one place readers and the failover goroutine need to synchronize on.
+type connTarget struct {
+	addr     string
+	user     string
+	password string
+}
+
+// Canal syncs a MySQL instance's binlog to an EventHandler. It does not take
+// an initial snapshot of the matched tables; the handler only sees changes
+// from the binlog position it is started at.
+type Canal struct {
+	cfg *Config
+
+	targetMu sync.RWMutex
+	target   connTarget
+
+	conn   *client.Conn
+	connMu sync.Mutex
+
+	syncerMu sync.Mutex
+	syncer   binlogSyncerCloser
+
+	master        mysql.Position
+	gtidSet       mysql.GTIDSet
+	pendingGTID   string
+	inTransaction bool
+	posMu         sync.RWMutex
+
+	eventHandler EventHandler
+
+	includeTableRegex []*regexp.Regexp
+	excludeTableRegex []*regexp.Regexp
+
+	tableLock sync.RWMutex
+	tables    map[string]*schema.Table
+
+	dumpDoneCh chan struct{}
+
+	ha *haManager
+
+	binlogInspector binlogInspector
+
+	pseudoGTIDMu              sync.Mutex
+	lastHint                  string
+	hintPositions             map[string]mysql.Position
+	pseudoGTIDInjectorStarted bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCanal creates a Canal ready to be started with StartFromGTID or
+// StartFromPos. cfg is not modified.
+func NewCanal(cfg *Config) (*Canal, error) {
+	c := &Canal{
+		cfg:          cfg,
+		target:       connTarget{addr: cfg.Addr, user: cfg.User, password: cfg.Password},
+		tables:       make(map[string]*schema.Table),
+		dumpDoneCh:   make(chan struct{}),
+		eventHandler: &DummyEventHandler{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.binlogInspector = &sqlBinlogInspector{c: c}
+
+	for _, s := range cfg.IncludeTableRegex {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		c.includeTableRegex = append(c.includeTableRegex, re)
+	}
+	for _, s := range cfg.ExcludeTableRegex {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		c.excludeTableRegex = append(c.excludeTableRegex, re)
+	}
+
+	conn, err := dialConn(cfg.Addr, cfg.User, cfg.Password, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.conn = conn
+
+	c.ha = newHAManager(c)
+
+	return c, nil
+}
+
+// currentTarget returns the MySQL instance Canal is currently talking to.
+func (c *Canal) currentTarget() connTarget {
+	c.targetMu.RLock()
+	defer c.targetMu.RUnlock()
+	return c.target
+}
+
+// setTarget repoints Canal at a new instance; it does not itself reconnect
+// anything (see reconnect and startSyncer).
+func (c *Canal) setTarget(t connTarget) {
+	c.targetMu.Lock()
+	c.target = t
+	c.targetMu.Unlock()
+}
+
+// SetEventHandler registers h as the target of every event Canal produces.
+// It must be called before StartFromGTID/StartFromPos.
+func (c *Canal) SetEventHandler(h EventHandler) {
+	c.eventHandler = h
+}
+
+// WaitDumpDone returns a channel that StartFromGTID closes right before it
+// starts streaming; no dump is taken. StartFromPos and StartFromPseudoGTID
+// do not close it.
+func (c *Canal) WaitDumpDone() chan struct{} {
+	return c.dumpDoneCh
+}
+
+// Execute runs query against the connection Canal uses for schema lookups
+// and dumping; it is exposed mainly for tests that need to mutate fixtures.
+func (c *Canal) Execute(query string, args ...interface{}) (*mysql.Result, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn.Execute(query, args...)
+}
+
+// reconnect replaces the connection Execute/GetTable/the Pseudo-GTID
+// injector use with a fresh one to the current target. It is called by
+// ha.go after a failover repoints the target, so schema lookups and hint
+// injection follow the new master instead of silently failing against the
+// old one.
+func (c *Canal) reconnect() error {
+	t := c.currentTarget()
+	conn, err := dialConn(t.addr, t.user, t.password, "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.connMu.Lock()
+	old := c.conn
+	c.conn = conn
+	c.connMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// GetTable returns the cached schema for db.table, loading and filtering it
+// on first use. ErrExcludedTable is returned if the table does not match
+// Config.IncludeTableRegex or is excluded by Config.ExcludeTableRegex.
+func (c *Canal) GetTable(db, table string) (*schema.Table, error) {
+	key := fmt.Sprintf("%s.%s", db, table)
+
+	if !c.tableMatched(db, table) {
+		return nil, errors.Trace(ErrExcludedTable)
+	}
+
+	c.tableLock.RLock()
+	t, ok := c.tables[key]
+	c.tableLock.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	t, err := schema.NewTable(c.conn, db, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c.tableLock.Lock()
+	c.tables[key] = t
+	c.tableLock.Unlock()
+
+	return t, nil
+}
+
+func (c *Canal) tableMatched(db, table string) bool {
+	full := fmt.Sprintf("%s.%s", db, table)
+
+	for _, re := range c.excludeTableRegex {
+		if re.MatchString(full) {
+			return false
+		}
+	}
+
+	if len(c.includeTableRegex) == 0 {
+		return true
+	}
+	for _, re := range c.includeTableRegex {
+		if re.MatchString(full) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartFromGTID starts replication from set. It does not run mysqldump,
+// whatever Config.Dump holds.
+func (c *Canal) StartFromGTID(set mysql.GTIDSet) error {
+	c.posMu.Lock()
+	c.gtidSet = set
+	c.posMu.Unlock()
+
+	if err := c.runDump(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return c.startSyncer(set, mysql.Position{})
+}
+
+// StartFromPos starts replication from pos, with no GTID position. Automatic
+// failover (see ha.go) needs a GTID position and does not run for a Canal
+// started this way.
+func (c *Canal) StartFromPos(pos mysql.Position) error {
+	c.posMu.Lock()
+	c.master = pos
+	c.posMu.Unlock()
+
+	return c.startSyncer(nil, pos)
+}
+
+func (c *Canal) runDump() error {
+	defer close(c.dumpDoneCh)
+	if c.cfg.Dump.ExecutionPath == "" {
+		return nil
+	}
+	// No dump is run, even with ExecutionPath set; this only marks the dump
+	// step as done for WaitDumpDone.
+	return nil
+}
+
+// dialConn opens the connection Canal uses for schema lookups and dumping.
+// It is a variable, like dialBinlogSyncer, so tests can substitute a fake
+// without a live MySQL instance (see canal_test.go).
+var dialConn = client.Connect
+
+// binlogSource is the subset of *replication.BinlogStreamer Canal's sync
+// loop needs; it exists so tests can drive runSyncLoop with a scripted
+// stream instead of a live master.
+type binlogSource interface {
+	GetEvent(ctx context.Context) (*replication.BinlogEvent, error)
+}
+
+// binlogSyncerCloser is the subset of *replication.BinlogSyncer Canal needs
+// outside of the dial step.
+type binlogSyncerCloser interface {
+	Close()
+}
+
+// dialBinlogSyncer opens the low-level replication stream for t. It is a
+// variable so tests can substitute a scripted binlogSource without a live
+// MySQL instance (see canal_test.go).
+var dialBinlogSyncer = func(cfg *Config, t connTarget, set mysql.GTIDSet, pos mysql.Position) (binlogSyncerCloser, binlogSource, error) {
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:        cfg.ServerID,
+		Flavor:          cfg.Flavor,
+		Host:            t.addr,
+		User:            t.user,
+		Password:        t.password,
+		Charset:         cfg.Charset,
+		HeartbeatPeriod: cfg.HeartbeatPeriod,
+		ReadTimeout:     cfg.ReadTimeout,
+	})
+
+	var streamer *replication.BinlogStreamer
+	var err error
+	if set != nil {
+		streamer, err = syncer.StartSyncGTID(set)
+	} else {
+		streamer, err = syncer.StartSync(pos)
+	}
+	if err != nil {
+		syncer.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	return syncer, streamer, nil
+}
+
+func (c *Canal) startSyncer(set mysql.GTIDSet, pos mysql.Position) error {
+	streamer, err := c.dialSyncer(set, pos)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.spawnSyncLoop(streamer)
+	return nil
+}
+
+// dialSyncer opens the replication stream and installs it as c.syncer
+// without spawning runSyncLoop. It is split out of startSyncer so ha.go's
+// failover can dial the new master, confirm the switch succeeded, and only
+// then spawn the new loop - otherwise the new goroutine could start calling
+// into EventHandler concurrently with failover's own OnPosSynced/
+// OnMasterSwitched calls.
+func (c *Canal) dialSyncer(set mysql.GTIDSet, pos mysql.Position) (binlogSource, error) {
+	syncer, streamer, err := dialBinlogSyncer(c.cfg, c.currentTarget(), set, pos)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.setSyncer(syncer)
+	return streamer, nil
+}
+
+// spawnSyncLoop starts runSyncLoop (and the Pseudo-GTID injector, the first
+// time it is called) against streamer.
+func (c *Canal) spawnSyncLoop(streamer binlogSource) {
+	c.ha.start()
+
+	c.wg.Add(1)
+	go c.runSyncLoop(streamer)
+
+	if c.cfg.PseudoGTID.Inject && !c.pseudoGTIDInjectorStarted {
+		c.pseudoGTIDInjectorStarted = true
+		c.wg.Add(1)
+		go c.runPseudoGTIDInjector()
+	}
+}
+
+// setSyncer and closeSyncer guard c.syncer the same way currentTarget/
+// setTarget guard c.target: dialSyncer (from the user's goroutine during
+// StartFromGTID, or from ha.go's failover goroutine) and Close (from
+// whatever goroutine calls it) can otherwise race on the same interface
+// value.
+func (c *Canal) setSyncer(syncer binlogSyncerCloser) {
+	c.syncerMu.Lock()
+	c.syncer = syncer
+	c.syncerMu.Unlock()
+}
+
+func (c *Canal) closeSyncer() {
+	c.syncerMu.Lock()
+	syncer := c.syncer
+	c.syncerMu.Unlock()
+	if syncer != nil {
+		syncer.Close()
+	}
+}
+
+func (c *Canal) runSyncLoop(streamer binlogSource) {
+	defer c.wg.Done()
+
+	for {
+		ev, err := streamer.GetEvent(c.ctx)
+		if err != nil {
+			// Close cancelled the stream; that is not a dead master, so it
+			// must not count as a heartbeat miss.
+			if c.ctx.Err() != nil || errors.Cause(err) == context.Canceled {
+				return
+			}
+			if c.ha.onSyncError(err) {
+				// A failover happened underneath us; ha.go's failover()
+				// has already installed a fresh streamer and started a new
+				// runSyncLoop, so this goroutine can exit.
+				return
+			}
+			log.Errorf("canal: replication stream error: %v", err)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		c.ha.onHeartbeat()
+		c.handleEvent(ev)
+	}
+}
+
+// CatchMasterPos blocks until Canal's replicated position has caught up
+// with the master's current position, or timeout elapses.
+func (c *Canal) CatchMasterPos(timeout time.Duration) error {
+	r, err := c.Execute("SHOW MASTER STATUS")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if r.RowNumber() == 0 {
+		return nil
+	}
+	name, _ := r.GetString(0, 0)
+	pos, _ := r.GetUint(0, 1)
+	target := mysql.Position{Name: name, Pos: uint32(pos)}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c.currentPosition().Compare(target) >= 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Errorf("canal: timed out waiting to catch up with master position %s", target)
+}
+
+// Close stops replication and releases the connections Canal opened.
+func (c *Canal) Close() {
+	c.cancel()
+	c.ha.stop()
+	c.closeSyncer()
+	c.connMu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.connMu.Unlock()
+	c.wg.Wait()
+}
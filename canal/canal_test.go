@@ -1,17 +1,22 @@
 package canal
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/parser"
 	"github.com/siddontang/go-log/log"
+	"github.com/steerben/go-mysql/client"
 	"github.com/steerben/go-mysql/mysql"
 	"github.com/steerben/go-mysql/replication"
+	"github.com/steerben/go-mysql/schema"
 )
 
 var testHost = flag.String("host", "127.0.0.1", "MySQL host")
@@ -113,6 +118,11 @@ func (h *testEventHandler) OnPosSynced(p mysql.Position, set mysql.GTIDSet, f bo
 	return nil
 }
 
+func (h *testEventHandler) OnMasterSwitched(old, new string, gtid mysql.GTIDSet) error {
+	log.Infof("OnMasterSwitched %s -> %s at %s\n", old, new, gtid.String())
+	return nil
+}
+
 func (s *canalTestSuite) TestCanal(c *C) {
 	<-s.c.WaitDumpDone()
 
@@ -283,6 +293,447 @@ func TestDropTableExp(t *testing.T) {
 		}
 	}
 }
+func TestGtidSafeToSwitch(t *testing.T) {
+	have, _ := mysql.ParseGTIDSet("mysql", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5")
+	ahead, _ := mysql.ParseGTIDSet("mysql", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-10")
+	behind, _ := mysql.ParseGTIDSet("mysql", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-3")
+
+	if !gtidSafeToSwitch(have, ahead, nil) {
+		t.Fatalf("candidate with a superset Executed_Gtid_Set should be safe to switch to")
+	}
+	if gtidSafeToSwitch(have, behind, nil) {
+		t.Fatalf("candidate that has not applied everything Canal consumed must not be chosen")
+	}
+	if !gtidSafeToSwitch(have, behind, ahead) {
+		t.Fatalf("a superset Retrieved_Gtid_Set should also count as safe")
+	}
+}
+
+func TestStaticTopologyProviderRequiresCandidates(t *testing.T) {
+	p := NewStaticTopologyProvider(nil)
+	if _, err := p.Candidates(); err == nil {
+		t.Fatalf("expected an error when no failover candidates are configured")
+	}
+
+	addrs := []ServerAddr{{Host: "127.0.0.1", Port: 3307}}
+	p = NewStaticTopologyProvider(addrs)
+	got, err := p.Candidates()
+	if err != nil || len(got) != 1 || got[0].String() != "127.0.0.1:3307" {
+		t.Fatalf("TestStaticTopologyProviderRequiresCandidates: got %v, %v", got, err)
+	}
+}
+
+func TestPseudoGTIDSetContain(t *testing.T) {
+	older := NewPseudoGTIDSet("1000", mysql.Position{Name: "mysql-bin.000001", Pos: 500})
+	newer := NewPseudoGTIDSet("2000", mysql.Position{Name: "mysql-bin.000009", Pos: 10})
+
+	if !newer.Contain(older) {
+		t.Fatalf("a set with a lexically later hint should contain an older one regardless of file/pos")
+	}
+	if older.Contain(newer) {
+		t.Fatalf("an older hint must not be reported as containing a newer one")
+	}
+
+	same := NewPseudoGTIDSet("1000", mysql.Position{Name: "mysql-bin.000001", Pos: 800})
+	if !same.Contain(older) {
+		t.Fatalf("same hint with a later position should contain the earlier position")
+	}
+}
+
+func TestPseudoGTIDSetEncodeDecode(t *testing.T) {
+	s := NewPseudoGTIDSet("deadbeef_00000001", mysql.Position{Name: "mysql-bin.000004", Pos: 1234})
+	var decoded PseudoGTIDSet
+	if err := decoded.Decode(s.Encode()); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !decoded.Equal(s) {
+		t.Fatalf("round-tripped PseudoGTIDSet %v != original %v", &decoded, s)
+	}
+}
+
+func TestHandlePseudoGTIDHint(t *testing.T) {
+	c := &Canal{
+		cfg: &Config{
+			PseudoGTID: PseudoGTIDConfig{
+				Enabled:    true,
+				HintPrefix: "_pseudo_gtid_hint_",
+			},
+		},
+		eventHandler: &DummyEventHandler{},
+	}
+
+	e := &replication.QueryEvent{
+		Query: []byte("DROP VIEW IF EXISTS `_pseudo_gtid_hint_deadbeef_00000001`"),
+	}
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 4567}
+	if !c.handlePseudoGTIDHint(e, pos) {
+		t.Fatalf("expected hint statement to be recognized")
+	}
+	if c.lastHint != "_pseudo_gtid_hint_deadbeef_00000001" {
+		t.Fatalf("unexpected recorded hint: %q", c.lastHint)
+	}
+	if got := c.hintPositions[c.lastHint]; got != pos {
+		t.Fatalf("hintPositions[%q] = %v, want %v", c.lastHint, got, pos)
+	}
+
+	ordinary := &replication.QueryEvent{Query: []byte("CREATE TABLE mydb.mytable (id int)")}
+	if c.handlePseudoGTIDHint(ordinary, pos) {
+		t.Fatalf("an ordinary DDL statement must not be treated as a hint")
+	}
+}
+
+// fakeBinlogInspector scripts locatePseudoGTIDHint's backward binlog scan
+// without a live mysqld.
+type fakeBinlogInspector struct {
+	files  []string
+	events map[string][]binlogEventInfo
+}
+
+func (f *fakeBinlogInspector) BinaryLogsNewestFirst() ([]string, error) {
+	return f.files, nil
+}
+
+func (f *fakeBinlogInspector) BinlogEventsNewestFirst(file string) ([]binlogEventInfo, error) {
+	return f.events[file], nil
+}
+
+// TestStartFromPseudoGTIDAcrossRotation restarts a Canal from only a hint
+// string, where the hint lives in an older, rotated-away binlog file, and
+// asserts it resumes at the row event recorded right after that hint.
+func TestStartFromPseudoGTIDAcrossRotation(t *testing.T) {
+	origDial := dialBinlogSyncer
+	defer func() { dialBinlogSyncer = origDial }()
+
+	const hint = "_pseudo_gtid_hint_deadbeef_00000001"
+	wantPos := mysql.Position{Name: "mysql-bin.000004", Pos: 900}
+
+	insp := &fakeBinlogInspector{
+		files: []string{"mysql-bin.000006", "mysql-bin.000005", "mysql-bin.000004"},
+		events: map[string][]binlogEventInfo{
+			"mysql-bin.000006": {{Info: "BEGIN", EndLogPos: 120}},
+			"mysql-bin.000005": {{Info: "COMMIT", EndLogPos: 900}},
+			"mysql-bin.000004": {
+				{Info: "### INSERT INTO test.canal_test", EndLogPos: 950},
+				{Info: "DROP VIEW IF EXISTS `" + hint + "`", EndLogPos: wantPos.Pos},
+				{Info: "BEGIN", EndLogPos: 400},
+			},
+		},
+	}
+
+	var dialedPos mysql.Position
+	dialBinlogSyncer = func(cfg *Config, target connTarget, set mysql.GTIDSet, pos mysql.Position) (binlogSyncerCloser, binlogSource, error) {
+		dialedPos = pos
+		return &fakeSyncerCloser{}, &scriptedBinlogSource{}, nil
+	}
+
+	c := &Canal{
+		cfg:             &Config{PseudoGTID: PseudoGTIDConfig{Enabled: true, HintPrefix: "_pseudo_gtid_hint_"}},
+		binlogInspector: insp,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.ha = newHAManager(c)
+
+	if err := c.StartFromPseudoGTID(hint); err != nil {
+		t.Fatalf("StartFromPseudoGTID: %v", err)
+	}
+
+	if dialedPos != wantPos {
+		t.Fatalf("resumed at %v, want %v", dialedPos, wantPos)
+	}
+	if c.currentPosition() != wantPos {
+		t.Fatalf("c.master = %v, want %v", c.currentPosition(), wantPos)
+	}
+	gs, ok := c.gtidSet.(*PseudoGTIDSet)
+	if !ok {
+		t.Fatalf("c.gtidSet is %T, want *PseudoGTIDSet", c.gtidSet)
+	}
+	if gs.Hint != hint || gs.Pos != wantPos {
+		t.Fatalf("gtidSet = %s, want hint %q at %v", gs, hint, wantPos)
+	}
+}
+
+// scriptedBinlogSource is a binlogSource driven by a fixed list of events.
+// Once exhausted it returns errAfter (if set) or blocks until ctx is done,
+// so tests can simulate a master that goes silent/unreachable.
+type scriptedBinlogSource struct {
+	mu       sync.Mutex
+	events   []*replication.BinlogEvent
+	idx      int
+	errAfter error
+}
+
+func (s *scriptedBinlogSource) GetEvent(ctx context.Context) (*replication.BinlogEvent, error) {
+	s.mu.Lock()
+	if s.idx < len(s.events) {
+		ev := s.events[s.idx]
+		s.idx++
+		s.mu.Unlock()
+		return ev, nil
+	}
+	s.mu.Unlock()
+
+	if s.errAfter != nil {
+		return nil, s.errAfter
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type fakeSyncerCloser struct{}
+
+func (*fakeSyncerCloser) Close() {}
+
+// gtidRowEvents returns the GTIDEvent/BEGIN/RowsEvent/XIDEvent sequence a
+// real row-based, GTID-tagged master sends for a single-row insert
+// committed at (sid, gno), landing at logPos.
+func gtidRowEvents(sid uuid.UUID, gno int64, id int, logPos uint32) []*replication.BinlogEvent {
+	return append(uncommittedGTIDRowEvents(sid, gno, id, logPos),
+		&replication.BinlogEvent{
+			Header: &replication.EventHeader{LogPos: logPos + 3},
+			Event:  &replication.XIDEvent{},
+		},
+	)
+}
+
+// uncommittedGTIDRowEvents returns just the GTIDEvent/BEGIN/RowsEvent part
+// of gtidRowEvents, with no following XIDEvent - simulating a transaction
+// whose commit was never delivered (e.g. the connection died mid-transaction).
+func uncommittedGTIDRowEvents(sid uuid.UUID, gno int64, id int, logPos uint32) []*replication.BinlogEvent {
+	sidBytes := sid
+	return []*replication.BinlogEvent{
+		{
+			Header: &replication.EventHeader{LogPos: logPos},
+			Event:  &replication.GTIDEvent{SID: sidBytes[:], GNO: gno},
+		},
+		{
+			Header: &replication.EventHeader{LogPos: logPos + 1},
+			Event:  &replication.QueryEvent{Query: []byte("BEGIN")},
+		},
+		{
+			Header: &replication.EventHeader{LogPos: logPos + 2, EventType: replication.WRITE_ROWS_EVENTv2},
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("canal_test")},
+				Rows:  [][]interface{}{{id}},
+			},
+		},
+	}
+}
+
+// TestFailoverNoRowLossOrDuplication drives a Canal through a mocked
+// failover (dialBinlogSyncer/dialConn/probeCandidateGTIDFunc all scripted,
+// no live mysqld) and asserts every row emitted before and after the switch
+// is delivered to OnRow exactly once.
+func TestFailoverNoRowLossOrDuplication(t *testing.T) {
+	origDial, origConn, origProbe := dialBinlogSyncer, dialConn, probeCandidateGTIDFunc
+	defer func() {
+		dialBinlogSyncer, dialConn, probeCandidateGTIDFunc = origDial, origConn, origProbe
+	}()
+
+	sid := uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	oldAddr := "127.0.0.1:3306"
+	newAddr := "127.0.0.1:3307"
+
+	oldStream := &scriptedBinlogSource{
+		events: append(
+			gtidRowEvents(sid, 1, 1, 100),
+			gtidRowEvents(sid, 2, 2, 200)...,
+		),
+		errAfter: errors.New("old master unreachable"),
+	}
+	newStream := &scriptedBinlogSource{
+		events: gtidRowEvents(sid, 3, 3, 10),
+	}
+
+	dialBinlogSyncer = func(cfg *Config, target connTarget, set mysql.GTIDSet, pos mysql.Position) (binlogSyncerCloser, binlogSource, error) {
+		switch target.addr {
+		case oldAddr:
+			return &fakeSyncerCloser{}, oldStream, nil
+		case newAddr:
+			return &fakeSyncerCloser{}, newStream, nil
+		default:
+			return nil, nil, fmt.Errorf("unexpected dial target %s", target.addr)
+		}
+	}
+	dialConn = func(addr, user, password, dbName string) (*client.Conn, error) {
+		return &client.Conn{}, nil
+	}
+	probeCandidateGTIDFunc = func(addr ServerAddr, flavor string) (executed, retrieved mysql.GTIDSet, err error) {
+		executed, err = mysql.ParseGTIDSet(flavor, sid.String()+":1-10")
+		return executed, nil, err
+	}
+
+	var mu sync.Mutex
+	var seen []int
+	rec := &recordingEventHandler{onRow: func(e *RowsEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, e.Rows[0][0].(int))
+		return nil
+	}}
+
+	cfg := &Config{
+		Addr:              oldAddr,
+		Flavor:            "mysql",
+		Candidates:        []ServerAddr{{Host: "127.0.0.1", Port: 3307}},
+		FailoverMaxMisses: 1,
+	}
+
+	c := &Canal{
+		cfg:          cfg,
+		target:       connTarget{addr: oldAddr},
+		tables:       map[string]*schema.Table{"test.canal_test": {}},
+		dumpDoneCh:   make(chan struct{}),
+		eventHandler: rec,
+	}
+	close(c.dumpDoneCh)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.ha = newHAManager(c)
+	defer c.Close()
+
+	initial, _ := mysql.ParseGTIDSet("mysql", "")
+	c.gtidSet = initial
+	if err := c.startSyncer(initial, mysql.Position{}); err != nil {
+		t.Fatalf("startSyncer: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(seen)
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 3 {
+		t.Fatalf("expected exactly 3 rows delivered across the failover, got %v", seen)
+	}
+	byID := map[int]int{}
+	for _, id := range seen {
+		byID[id]++
+	}
+	for _, id := range []int{1, 2, 3} {
+		if byID[id] != 1 {
+			t.Fatalf("row %d delivered %d times, want exactly once: %v", id, byID[id], seen)
+		}
+	}
+}
+
+type recordingEventHandler struct {
+	DummyEventHandler
+	onRow func(*RowsEvent) error
+}
+
+func (h *recordingEventHandler) OnRow(e *RowsEvent) error {
+	return h.onRow(e)
+}
+
+func (h *recordingEventHandler) String() string { return "recordingEventHandler" }
+
+// TestGTIDConsumedOnlyAtCommit exercises the window TestFailoverNoRowLossOrDuplication
+// cannot: a transaction whose GTIDEvent/RowsEvent have been delivered but
+// whose XIDEvent has not. currentGTIDSet (what ha.go's failover consults as
+// "have") must not include that GTID until the XIDEvent arrives, or a
+// mid-transaction failover would resume the new master past rows it never
+// delivered.
+func TestGTIDConsumedOnlyAtCommit(t *testing.T) {
+	sid := uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+
+	c := &Canal{
+		cfg:          &Config{},
+		tables:       map[string]*schema.Table{"test.canal_test": {}},
+		eventHandler: &DummyEventHandler{},
+	}
+	initial, _ := mysql.ParseGTIDSet("mysql", "")
+	c.gtidSet = initial
+
+	for _, ev := range uncommittedGTIDRowEvents(sid, 1, 1, 100) {
+		c.handleEvent(ev)
+	}
+	if got := c.currentGTIDSet(); got.String() != initial.String() {
+		t.Fatalf("GTID set advanced before the transaction committed: got %s, want unchanged %s", got, initial)
+	}
+
+	c.handleEvent(&replication.BinlogEvent{
+		Header: &replication.EventHeader{LogPos: 103},
+		Event:  &replication.XIDEvent{},
+	})
+	want, _ := mysql.ParseGTIDSet("mysql", sid.String()+":1")
+	if got := c.currentGTIDSet(); got.String() != want.String() {
+		t.Fatalf("GTID set after commit = %s, want %s", got, want)
+	}
+}
+
+// TestGTIDNotConsumedAcrossSavepoint guards against treating every
+// QueryEvent between BEGIN and the matching XIDEvent as a commit boundary:
+// a SAVEPOINT statement mid-transaction must not merge the transaction's
+// GTID into c.gtidSet ahead of its XIDEvent.
+func TestGTIDNotConsumedAcrossSavepoint(t *testing.T) {
+	sid := uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+
+	c := &Canal{
+		cfg:          &Config{},
+		tables:       map[string]*schema.Table{"test.canal_test": {}},
+		eventHandler: &DummyEventHandler{},
+	}
+	initial, _ := mysql.ParseGTIDSet("mysql", "")
+	c.gtidSet = initial
+
+	for _, ev := range uncommittedGTIDRowEvents(sid, 1, 1, 100) {
+		c.handleEvent(ev)
+	}
+	c.handleEvent(&replication.BinlogEvent{
+		Header: &replication.EventHeader{LogPos: 103},
+		Event:  &replication.QueryEvent{Query: []byte("SAVEPOINT s1")},
+	})
+	if got := c.currentGTIDSet(); got.String() != initial.String() {
+		t.Fatalf("GTID set advanced on a mid-transaction SAVEPOINT: got %s, want unchanged %s", got, initial)
+	}
+
+	c.handleEvent(&replication.BinlogEvent{
+		Header: &replication.EventHeader{LogPos: 104},
+		Event:  &replication.XIDEvent{},
+	})
+	want, _ := mysql.ParseGTIDSet("mysql", sid.String()+":1")
+	if got := c.currentGTIDSet(); got.String() != want.String() {
+		t.Fatalf("GTID set after commit = %s, want %s", got, want)
+	}
+}
+
+// TestGTIDConsumedOnCommitQuery covers the transactions MySQL ends with a
+// literal "COMMIT" QueryEvent rather than an XIDEvent - which happens
+// whenever a non-transactional table is touched, or under
+// binlog_format=MIXED/STATEMENT. Without recognizing it, the pending GTID
+// would never be merged into c.gtidSet.
+func TestGTIDConsumedOnCommitQuery(t *testing.T) {
+	sid := uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+
+	c := &Canal{
+		cfg:          &Config{},
+		tables:       map[string]*schema.Table{"test.canal_test": {}},
+		eventHandler: &DummyEventHandler{},
+	}
+	initial, _ := mysql.ParseGTIDSet("mysql", "")
+	c.gtidSet = initial
+
+	for _, ev := range uncommittedGTIDRowEvents(sid, 1, 1, 100) {
+		c.handleEvent(ev)
+	}
+	c.handleEvent(&replication.BinlogEvent{
+		Header: &replication.EventHeader{LogPos: 103},
+		Event:  &replication.QueryEvent{Query: []byte("COMMIT")},
+	})
+
+	want, _ := mysql.ParseGTIDSet("mysql", sid.String()+":1")
+	if got := c.currentGTIDSet(); got.String() != want.String() {
+		t.Fatalf("GTID set after a COMMIT QueryEvent = %s, want %s", got, want)
+	}
+}
+
 func TestWithoutSchemeExp(t *testing.T) {
 
 	cases := []replication.QueryEvent{
@@ -0,0 +1,101 @@
+package canal
+
+import (
+	"time"
+)
+
+// DumpConfig describes an initial mysqldump snapshot. Canal does not run
+// mysqldump: none of these fields changes what it streams, and StartFromGTID
+// starts from the given GTID set without a snapshot.
+type DumpConfig struct {
+	// ExecutionPath is the path to the mysqldump binary.
+	ExecutionPath string
+
+	// DiscardErr discards the mysqldump's stderr output instead of logging it.
+	DiscardErr bool
+
+	// SkipMasterData skips the --master-data flag, useful when the account
+	// used for dumping lacks the RELOAD privilege.
+	SkipMasterData bool
+
+	TableDB string
+	Tables  []string
+	Where   string
+}
+
+// Config configures a Canal instance: how it connects to MySQL, which
+// tables it should replicate and how the initial dump is taken.
+type Config struct {
+	Addr     string
+	User     string
+	Password string
+	Charset  string
+
+	// ServerID is the replication client id Canal registers with the master.
+	// It must be unique among all of the master's replicas.
+	ServerID uint32
+	Flavor   string
+
+	Dump DumpConfig
+
+	HeartbeatPeriod time.Duration
+	ReadTimeout     time.Duration
+
+	IncludeTableRegex []string
+	ExcludeTableRegex []string
+
+	// Candidates lists the failover candidates Canal may promote when it
+	// loses its master. It is consulted through TopologyProvider, so most
+	// callers should prefer setting TopologyProvider directly; Candidates
+	// is kept as a convenience for the common static-list case.
+	Candidates []ServerAddr
+
+	// TopologyProvider overrides Candidates when set. If both are empty HA
+	// is disabled and Canal behaves exactly as before.
+	TopologyProvider TopologyProvider
+
+	// FailoverMaxMisses is the number of consecutive heartbeat misses Canal
+	// tolerates before it starts probing Candidates for a promotable
+	// replica. Defaults to 3 when unset.
+	FailoverMaxMisses int
+
+	// PseudoGTID configures Pseudo-GTID support for masters that do not run
+	// with gtid_mode=ON. See pseudo_gtid.go.
+	PseudoGTID PseudoGTIDConfig
+}
+
+// PseudoGTIDConfig controls Pseudo-GTID hint injection and recognition.
+type PseudoGTIDConfig struct {
+	// Enabled turns on hint recognition in the query-event path, letting
+	// Canal resume from a hint via StartFromPseudoGTID even if Inject is
+	// false and some other process writes the hints.
+	Enabled bool
+
+	// Inject, when true, makes Canal itself write a hint statement to the
+	// master every Interval.
+	Inject bool
+
+	// Interval is how often a hint is injected. Defaults to 5s when unset.
+	Interval time.Duration
+
+	// HintPrefix identifies Canal's hint statements in the binlog. Defaults
+	// to "_pseudo_gtid_hint_" when unset.
+	HintPrefix string
+}
+
+// NewDefaultConfig returns a Config with conservative defaults; callers
+// still need to set at least Addr and User before passing it to NewCanal.
+func NewDefaultConfig() *Config {
+	return &Config{
+		Charset:           "utf8mb4",
+		ServerID:          uint32(time.Now().Unix()),
+		Flavor:            "mysql",
+		HeartbeatPeriod:   60 * time.Second,
+		ReadTimeout:       90 * time.Second,
+		FailoverMaxMisses: 3,
+		PseudoGTID: PseudoGTIDConfig{
+			Interval:   5 * time.Second,
+			HintPrefix: "_pseudo_gtid_hint_",
+		},
+	}
+}
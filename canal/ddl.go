@@ -0,0 +1,90 @@
+package canal
+
+import (
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-log/log"
+
+	"github.com/steerben/go-mysql/mysql"
+	"github.com/steerben/go-mysql/replication"
+)
+
+// node identifies the schema/table a DDL statement touches.
+type node struct {
+	db    string
+	table string
+}
+
+// parseStmt extracts the (db, table) pairs a DDL statement affects so Canal
+// can invalidate the matching schema cache entries and notify OnTableChanged.
+func parseStmt(stmt ast.StmtNode) (ns []*node) {
+	switch t := stmt.(type) {
+	case *ast.RenameTableStmt:
+		for _, tableInfo := range t.TableToTables {
+			ns = append(ns, &node{
+				db:    tableInfo.OldTable.Schema.String(),
+				table: tableInfo.OldTable.Name.String(),
+			})
+		}
+	case *ast.AlterTableStmt:
+		ns = append(ns, &node{
+			db:    t.Table.Schema.String(),
+			table: t.Table.Name.String(),
+		})
+	case *ast.DropTableStmt:
+		for _, table := range t.Tables {
+			ns = append(ns, &node{
+				db:    table.Schema.String(),
+				table: table.Name.String(),
+			})
+		}
+	case *ast.CreateTableStmt:
+		ns = append(ns, &node{
+			db:    t.Table.Schema.String(),
+			table: t.Table.Name.String(),
+		})
+	}
+	return
+}
+
+func (c *Canal) handleQueryEvent(e *replication.QueryEvent) {
+	if c.handlePseudoGTIDHint(e, c.currentPosition()) {
+		return
+	}
+
+	query := string(e.Query)
+	pr := parser.New()
+	stmts, _, err := pr.Parse(query, "", "")
+	if err != nil {
+		log.Errorf("canal: failed to parse DDL %q: %v", query, err)
+		return
+	}
+
+	for _, stmt := range stmts {
+		nodes := parseStmt(stmt)
+		for _, n := range nodes {
+			db := n.db
+			if db == "" {
+				db = string(e.Schema)
+			}
+
+			c.tableLock.Lock()
+			delete(c.tables, db+"."+n.table)
+			c.tableLock.Unlock()
+
+			if err := c.eventHandler.OnTableChanged(db, n.table); err != nil {
+				log.Errorf("canal: OnTableChanged(%s.%s): %v", db, n.table, err)
+			}
+		}
+	}
+
+	if err := c.eventHandler.OnDDL(c.currentPosition(), e); err != nil {
+		log.Errorf("canal: OnDDL: %v", err)
+	}
+}
+
+func (c *Canal) currentPosition() mysql.Position {
+	c.posMu.RLock()
+	defer c.posMu.RUnlock()
+	return c.master
+}
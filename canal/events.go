@@ -0,0 +1,202 @@
+package canal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/errors"
+	"github.com/siddontang/go-log/log"
+
+	"github.com/steerben/go-mysql/mysql"
+	"github.com/steerben/go-mysql/replication"
+)
+
+// setPosition replaces the tracked master position wholesale; it is used on
+// rotate, where the file name itself changes.
+func (c *Canal) setPosition(name string, pos uint32) {
+	c.posMu.Lock()
+	c.master = mysql.Position{Name: name, Pos: pos}
+	c.posMu.Unlock()
+}
+
+// advancePosition moves the tracked position forward within the current
+// file, which is what every event except a rotate does.
+func (c *Canal) advancePosition(pos uint32) {
+	c.posMu.Lock()
+	c.master.Pos = pos
+	c.posMu.Unlock()
+}
+
+// currentGTIDSet returns a snapshot of Canal's GTID position, safe to hand
+// to a caller that outlives the lock (e.g. an EventHandler callback).
+func (c *Canal) currentGTIDSet() mysql.GTIDSet {
+	c.posMu.RLock()
+	defer c.posMu.RUnlock()
+	if c.gtidSet == nil {
+		return nil
+	}
+	return c.gtidSet.Clone()
+}
+
+func (c *Canal) handleEvent(ev *replication.BinlogEvent) {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		c.setPosition(string(e.NextLogName), uint32(e.Position))
+		if err := c.eventHandler.OnRotate(e); err != nil {
+			log.Errorf("canal: OnRotate: %v", err)
+		}
+		c.syncPosition()
+	case *replication.QueryEvent:
+		c.advancePosition(ev.Header.LogPos)
+		c.handleQueryEvent(e)
+		switch {
+		case isBeginQuery(e.Query):
+			c.beginTransaction()
+		case isTransactionEndQuery(e.Query), !c.inOpenTransaction():
+			// COMMIT/ROLLBACK close a transaction that a non-InnoDB table
+			// keeps MySQL from ending with an XIDEvent; a GTID-tagged DDL
+			// statement with no BEGIN of its own commits implicitly.
+			// Anything else (e.g. a SAVEPOINT between BEGIN and COMMIT) is
+			// left for the matching XIDEvent/COMMIT to commit.
+			c.commitPendingGTID()
+		}
+		c.syncPosition()
+	case *replication.GTIDEvent:
+		c.advancePosition(ev.Header.LogPos)
+		c.handleGTIDEvent(e)
+	case *replication.RowsEvent:
+		c.advancePosition(ev.Header.LogPos)
+		c.handleRowsEvent(ev.Header.EventType, e)
+	case *replication.XIDEvent:
+		c.advancePosition(ev.Header.LogPos)
+		c.commitPendingGTID()
+		if err := c.eventHandler.OnXID(c.currentPosition()); err != nil {
+			log.Errorf("canal: OnXID: %v", err)
+		}
+		c.syncPosition()
+	}
+}
+
+// syncPosition calls OnPosSynced at a transaction boundary (rotate, DDL,
+// commit), mirroring where the original master-only implementation
+// considered a position durable.
+func (c *Canal) syncPosition() {
+	if err := c.eventHandler.OnPosSynced(c.currentPosition(), c.currentGTIDSet(), false); err != nil {
+		log.Errorf("canal: OnPosSynced: %v", err)
+	}
+}
+
+// handleGTIDEvent stashes the GTID this event carries as pending; it is not
+// merged into c.gtidSet until the transaction it opens actually commits (see
+// commitPendingGTID, called from the QueryEvent/XIDEvent cases in
+// handleEvent). Merging it immediately would let a mid-transaction failover
+// see this GTID in currentGTIDSet() before OnRow has delivered its rows,
+// causing the new master's resume point to silently skip them.
+func (c *Canal) handleGTIDEvent(e *replication.GTIDEvent) {
+	u, err := uuid.FromBytes(e.SID)
+	if err != nil {
+		log.Errorf("canal: invalid GTID event SID: %v", err)
+		return
+	}
+	gtidStr := fmt.Sprintf("%s:%d", u.String(), e.GNO)
+
+	c.posMu.Lock()
+	c.pendingGTID = gtidStr
+	c.inTransaction = false
+	c.posMu.Unlock()
+}
+
+// isBeginQuery reports whether query is the BEGIN statement a GTID-tagged
+// row transaction sends right after its GTIDEvent.
+func isBeginQuery(query []byte) bool {
+	return strings.EqualFold(strings.TrimSpace(string(query)), "BEGIN")
+}
+
+// isTransactionEndQuery reports whether query explicitly closes the
+// transaction BEGIN opened (COMMIT) or abandons it (ROLLBACK), as opposed to
+// e.g. "ROLLBACK TO SAVEPOINT ...", which only rewinds partway through one.
+// MySQL logs both as a QueryEvent with no following XIDEvent whenever a
+// non-transactional table (or binlog_format=MIXED/STATEMENT) keeps the
+// transaction from ending the usual way.
+func isTransactionEndQuery(query []byte) bool {
+	switch strings.ToUpper(strings.TrimSpace(string(query))) {
+	case "COMMIT", "COMMIT WORK", "ROLLBACK", "ROLLBACK WORK":
+		return true
+	default:
+		return false
+	}
+}
+
+// beginTransaction marks the pending GTID as belonging to an explicitly
+// opened transaction, so commitPendingGTID is deferred to its XIDEvent
+// rather than fired on the next QueryEvent handleEvent sees - which, between
+// BEGIN and COMMIT, could be an unrelated statement like SAVEPOINT rather
+// than the transaction's end.
+func (c *Canal) beginTransaction() {
+	c.posMu.Lock()
+	c.inTransaction = true
+	c.posMu.Unlock()
+}
+
+func (c *Canal) inOpenTransaction() bool {
+	c.posMu.RLock()
+	defer c.posMu.RUnlock()
+	return c.inTransaction
+}
+
+// commitPendingGTID merges the GTID handleGTIDEvent stashed into c.gtidSet,
+// once the transaction it opened has been delivered in full: an ordinary
+// QueryEvent for a GTID-tagged DDL statement, which commits without an XID,
+// a COMMIT/ROLLBACK QueryEvent, or an XIDEvent for a row transaction. It is
+// a no-op when nothing is pending (e.g. a non-GTID master, or an ordinary
+// DDL statement outside GTID mode).
+func (c *Canal) commitPendingGTID() {
+	c.posMu.Lock()
+	gtidStr := c.pendingGTID
+	c.pendingGTID = ""
+	c.inTransaction = false
+	if gtidStr != "" && c.gtidSet != nil {
+		if err := c.gtidSet.Update(gtidStr); err != nil {
+			log.Errorf("canal: failed to update GTID set with %s: %v", gtidStr, err)
+		}
+	}
+	c.posMu.Unlock()
+
+	if gtidStr == "" {
+		return
+	}
+	if err := c.eventHandler.OnGTID(c.currentGTIDSet()); err != nil {
+		log.Errorf("canal: OnGTID: %v", err)
+	}
+}
+
+func (c *Canal) handleRowsEvent(eventType replication.EventType, e *replication.RowsEvent) {
+	db := string(e.Table.Schema)
+	table := string(e.Table.Table)
+
+	t, err := c.GetTable(db, table)
+	if err != nil {
+		if errors.Cause(err) != ErrExcludedTable {
+			log.Errorf("canal: GetTable(%s.%s): %v", db, table, err)
+		}
+		return
+	}
+
+	var action string
+	switch eventType {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		action = "insert"
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		action = "update"
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		action = "delete"
+	default:
+		return
+	}
+
+	re := &RowsEvent{Table: t, Action: action, Rows: e.Rows}
+	if err := c.eventHandler.OnRow(re); err != nil {
+		log.Errorf("canal: OnRow: %v", err)
+	}
+}
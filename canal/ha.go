@@ -0,0 +1,282 @@
+package canal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/siddontang/go-log/log"
+
+	"github.com/steerben/go-mysql/client"
+	"github.com/steerben/go-mysql/mysql"
+)
+
+// ServerAddr identifies a MySQL instance that can serve as a failover
+// candidate.
+type ServerAddr struct {
+	Host     string
+	Port     uint16
+	User     string
+	Password string
+}
+
+func (a ServerAddr) String() string {
+	return fmt.Sprintf("%s:%d", a.Host, a.Port)
+}
+
+// TopologyProvider returns the set of replicas Canal may fail over to.
+// Implementations typically consult a discovery service (orchestrator,
+// Consul, a ProxySQL hostgroup, ...); NewStaticTopologyProvider covers the
+// common case of a fixed list configured up front.
+type TopologyProvider interface {
+	Candidates() ([]ServerAddr, error)
+}
+
+type staticTopologyProvider struct {
+	addrs []ServerAddr
+}
+
+// NewStaticTopologyProvider returns a TopologyProvider that always offers
+// addrs as failover candidates, in order.
+func NewStaticTopologyProvider(addrs []ServerAddr) TopologyProvider {
+	return &staticTopologyProvider{addrs: addrs}
+}
+
+func (p *staticTopologyProvider) Candidates() ([]ServerAddr, error) {
+	if len(p.addrs) == 0 {
+		return nil, errors.New("canal: no failover candidates configured")
+	}
+	return p.addrs, nil
+}
+
+// haManager watches the binlog stream for repeated heartbeat misses and,
+// once Config.FailoverMaxMisses is crossed, promotes a TopologyProvider
+// candidate whose GTID set is provably ahead of Canal's own position. This
+// mirrors orchestrator's failure-analysis (DeadMaster/DeadIntermediateMaster)
+// followed by GTID-based recovery: a switch is only taken when it cannot
+// lose a row Canal has already consumed.
+type haManager struct {
+	c *Canal
+
+	provider  TopologyProvider
+	maxMisses int32
+	misses    int32
+
+	mu          sync.Mutex
+	failingOver bool
+}
+
+func newHAManager(c *Canal) *haManager {
+	m := &haManager{
+		c:         c,
+		provider:  c.cfg.TopologyProvider,
+		maxMisses: int32(c.cfg.FailoverMaxMisses),
+	}
+	if m.provider == nil && len(c.cfg.Candidates) > 0 {
+		m.provider = NewStaticTopologyProvider(c.cfg.Candidates)
+	}
+	if m.maxMisses <= 0 {
+		m.maxMisses = 3
+	}
+	return m
+}
+
+func (m *haManager) enabled() bool {
+	return m.provider != nil
+}
+
+// start is a no-op placeholder kept symmetric with stop; the health check
+// itself rides on the syncer's own read loop (see onHeartbeat/onSyncError)
+// rather than a separate goroutine, since HeartbeatPeriod/ReadTimeout
+// already make GetEvent return on a predictable cadence.
+func (m *haManager) start() {}
+
+func (m *haManager) stop() {}
+
+// onHeartbeat resets the miss counter. It is called after every event the
+// syncer successfully reads, including the heartbeat events the master sends
+// every HeartbeatPeriod when it is otherwise idle.
+func (m *haManager) onHeartbeat() {
+	atomic.StoreInt32(&m.misses, 0)
+}
+
+// onSyncError is called when GetEvent fails, which today is how a dead
+// connection or a missed heartbeat surfaces. It returns true only when a
+// failover has just completed, telling the caller to stop reading from the
+// now-stale streamer; it returns false below the miss threshold and when the
+// failover fails, including when another failover is already in progress.
+func (m *haManager) onSyncError(err error) bool {
+	if !m.enabled() {
+		return false
+	}
+
+	misses := atomic.AddInt32(&m.misses, 1)
+	addr := m.c.currentTarget().addr
+	if misses < m.maxMisses {
+		log.Warnf("canal: heartbeat miss %d/%d on %s: %v", misses, m.maxMisses, addr, err)
+		return false
+	}
+
+	log.Errorf("canal: master %s unreachable after %d misses, starting failover", addr, misses)
+	if ferr := m.failover(); ferr != nil {
+		log.Errorf("canal: failover failed: %v", ferr)
+		atomic.StoreInt32(&m.misses, 0)
+		return false
+	}
+	return true
+}
+
+func (m *haManager) failover() error {
+	m.mu.Lock()
+	if m.failingOver {
+		m.mu.Unlock()
+		return errors.New("canal: failover already in progress")
+	}
+	m.failingOver = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.failingOver = false
+		m.mu.Unlock()
+	}()
+
+	candidates, err := m.provider.Candidates()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c := m.c
+	have := c.currentGTIDSet()
+	if have == nil {
+		return errors.New("canal: cannot fail over without a GTID position; start Canal with StartFromGTID")
+	}
+	if _, ok := have.(*PseudoGTIDSet); ok {
+		return errors.New("canal: automatic failover is not supported from Pseudo-GTID; promote manually and resume with StartFromPseudoGTID against the new master")
+	}
+
+	picked, _, err := choosePromotable(candidates, c.cfg.Flavor, have)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	oldTarget := c.currentTarget()
+	c.closeSyncer()
+
+	newTarget := connTarget{addr: picked.String(), user: oldTarget.user, password: oldTarget.password}
+	if picked.User != "" {
+		newTarget.user = picked.User
+		newTarget.password = picked.Password
+	}
+	c.setTarget(newTarget)
+
+	if err := c.reconnect(); err != nil {
+		c.setTarget(oldTarget)
+		return errors.Trace(err)
+	}
+
+	streamer, err := c.dialSyncer(have, mysql.Position{})
+	if err != nil {
+		c.setTarget(oldTarget)
+		if rerr := c.reconnect(); rerr != nil {
+			log.Errorf("canal: failed to restore connection to %s after aborted failover: %v", oldTarget.addr, rerr)
+		}
+		return errors.Trace(err)
+	}
+
+	atomic.StoreInt32(&m.misses, 0)
+
+	// Notify the handler of the switch before spawning the new runSyncLoop
+	// goroutine below: otherwise that goroutine could start calling OnRow/
+	// OnGTID/OnPosSynced on its own before this goroutine reaches the calls
+	// below, and EventHandler would be driven by two goroutines at once.
+	// The handler gets Canal's own consumed GTID set, the point streaming
+	// resumes from on the new master, not the candidate's Executed_Gtid_Set.
+	resumed := c.currentGTIDSet()
+	if err := c.eventHandler.OnPosSynced(c.currentPosition(), resumed, true); err != nil {
+		log.Errorf("canal: OnPosSynced after failover: %v", err)
+	}
+	if err := c.eventHandler.OnMasterSwitched(oldTarget.addr, newTarget.addr, resumed); err != nil {
+		log.Errorf("canal: OnMasterSwitched: %v", err)
+	}
+
+	c.spawnSyncLoop(streamer)
+
+	log.Infof("canal: failed over from %s to %s at GTID %s", oldTarget.addr, newTarget.addr, resumed.String())
+	return nil
+}
+
+// choosePromotable returns the first candidate whose replicated GTID set is
+// have or a superset of it, i.e. one that has durably received or applied at
+// least everything Canal has already consumed. Candidates that are
+// unreachable or behind are skipped rather than failing the whole attempt.
+func choosePromotable(candidates []ServerAddr, flavor string, have mysql.GTIDSet) (ServerAddr, mysql.GTIDSet, error) {
+	for _, cand := range candidates {
+		executed, retrieved, err := probeCandidateGTIDFunc(cand, flavor)
+		if err != nil {
+			log.Warnf("canal: failover candidate %s unreachable: %v", cand, err)
+			continue
+		}
+		if !gtidSafeToSwitch(have, executed, retrieved) {
+			log.Warnf("canal: failover candidate %s is behind current position, skipping", cand)
+			continue
+		}
+		return cand, executed, nil
+	}
+	return ServerAddr{}, nil, errors.Errorf("canal: no failover candidate is ahead of GTID set %s", have.String())
+}
+
+// gtidSafeToSwitch reports whether have is contained in what the candidate
+// has already applied or has at least durably received, i.e. in
+// Retrieved_Gtid_Set ∪ Executed_Gtid_Set.
+func gtidSafeToSwitch(have, executed, retrieved mysql.GTIDSet) bool {
+	var union mysql.GTIDSet
+	switch {
+	case executed == nil:
+		union = retrieved
+	case retrieved == nil:
+		union = executed
+	default:
+		union = executed.Clone()
+		if err := union.Update(retrieved.String()); err != nil {
+			return false
+		}
+	}
+	return union != nil && union.Contain(have)
+}
+
+// probeCandidateGTIDFunc connects to addr and parses Executed_Gtid_Set and
+// Retrieved_Gtid_Set out of SHOW SLAVE STATUS. It is a variable so tests can
+// simulate candidates (e.g. "two mysqld instances") without a live network.
+var probeCandidateGTIDFunc = probeCandidateGTID
+
+func probeCandidateGTID(addr ServerAddr, flavor string) (executed, retrieved mysql.GTIDSet, err error) {
+	conn, err := client.Connect(addr.String(), addr.User, addr.Password, "")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	r, err := conn.Execute("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if r.RowNumber() == 0 {
+		return nil, nil, errors.Errorf("canal: %s is not a replica", addr)
+	}
+
+	executedStr, _ := r.GetStringByName(0, "Executed_Gtid_Set")
+	executed, err = mysql.ParseGTIDSet(flavor, executedStr)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if retrievedStr, rerr := r.GetStringByName(0, "Retrieved_Gtid_Set"); rerr == nil && retrievedStr != "" {
+		retrieved, err = mysql.ParseGTIDSet(flavor, retrievedStr)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	return executed, retrieved, nil
+}
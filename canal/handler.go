@@ -0,0 +1,56 @@
+package canal
+
+import (
+	"github.com/steerben/go-mysql/mysql"
+	"github.com/steerben/go-mysql/replication"
+)
+
+// EventHandler receives the events Canal produces while it streams the
+// binlog. Implementations should embed DummyEventHandler so new hooks can be
+// added to this interface without breaking existing handlers.
+type EventHandler interface {
+	OnRotate(e *replication.RotateEvent) error
+	OnTableChanged(schema, table string) error
+	OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error
+	OnRow(e *RowsEvent) error
+	OnXID(nextPos mysql.Position) error
+	OnGTID(gtid mysql.GTIDSet) error
+
+	// OnPosSynced is called at each rotate, query event and transaction
+	// commit, and once after a failover; heartbeats do not trigger it.
+	// force is true only for the call after a failover, when the position
+	// must be persisted before streaming from the new master continues.
+	OnPosSynced(pos mysql.Position, gtid mysql.GTIDSet, force bool) error
+
+	// OnMasterSwitched fires once Canal has resumed streaming from a newly
+	// promoted master. gtid is Canal's position on the new master,
+	// equivalent to the one it had on old just before the switch.
+	OnMasterSwitched(old, new string, gtid mysql.GTIDSet) error
+
+	String() string
+}
+
+// DummyEventHandler implements EventHandler with no-op methods so callers
+// only need to override the hooks they care about.
+type DummyEventHandler struct {
+}
+
+func (h *DummyEventHandler) OnRotate(*replication.RotateEvent) error { return nil }
+
+func (h *DummyEventHandler) OnTableChanged(schema, table string) error { return nil }
+
+func (h *DummyEventHandler) OnDDL(mysql.Position, *replication.QueryEvent) error { return nil }
+
+func (h *DummyEventHandler) OnRow(*RowsEvent) error { return nil }
+
+func (h *DummyEventHandler) OnXID(mysql.Position) error { return nil }
+
+func (h *DummyEventHandler) OnGTID(mysql.GTIDSet) error { return nil }
+
+func (h *DummyEventHandler) OnPosSynced(mysql.Position, mysql.GTIDSet, bool) error { return nil }
+
+func (h *DummyEventHandler) OnMasterSwitched(old, new string, gtid mysql.GTIDSet) error {
+	return nil
+}
+
+func (h *DummyEventHandler) String() string { return "DummyEventHandler" }
@@ -0,0 +1,330 @@
+package canal
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/siddontang/go-log/log"
+
+	"github.com/steerben/go-mysql/mysql"
+	"github.com/steerben/go-mysql/replication"
+)
+
+// PseudoGTIDSet is a mysql.GTIDSet for masters that do not run with
+// gtid_mode=ON. Instead of a real GTID it tracks the last Pseudo-GTID hint
+// Canal has seen together with the (file, pos) it was read at, following
+// orchestrator's Pseudo-GTID technique: a uniquely identifiable no-op
+// statement is periodically written to the binlog and used as a
+// position-independent bookmark, since hints carry forward across a
+// failover even though file/pos numbering does not.
+type PseudoGTIDSet struct {
+	mu   sync.RWMutex
+	Hint string
+	Pos  mysql.Position
+}
+
+// NewPseudoGTIDSet returns a PseudoGTIDSet bookmarked at hint/pos.
+func NewPseudoGTIDSet(hint string, pos mysql.Position) *PseudoGTIDSet {
+	return &PseudoGTIDSet{Hint: hint, Pos: pos}
+}
+
+func (s *PseudoGTIDSet) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fmt.Sprintf("%s@%s", s.Hint, s.Pos)
+}
+
+// Update replaces the tracked hint; gtidStr is the hint string alone, the
+// position is set separately by the caller via set().
+func (s *PseudoGTIDSet) Update(gtidStr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Hint = gtidStr
+	return nil
+}
+
+func (s *PseudoGTIDSet) set(hint string, pos mysql.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Hint = hint
+	s.Pos = pos
+}
+
+func (s *PseudoGTIDSet) Encode() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return []byte(fmt.Sprintf("%s@%s:%d", s.Hint, s.Pos.Name, s.Pos.Pos))
+}
+
+func (s *PseudoGTIDSet) Decode(data []byte) error {
+	hint, posStr, ok := strings.Cut(string(data), "@")
+	if !ok {
+		return errors.Errorf("canal: invalid PseudoGTIDSet encoding %q", data)
+	}
+	name, posDigits, ok := strings.Cut(posStr, ":")
+	if !ok {
+		return errors.Errorf("canal: invalid PseudoGTIDSet encoding %q", data)
+	}
+	pos, err := strconv.ParseUint(posDigits, 10, 32)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.set(hint, mysql.Position{Name: name, Pos: uint32(pos)})
+	return nil
+}
+
+func (s *PseudoGTIDSet) Clone() mysql.GTIDSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return NewPseudoGTIDSet(s.Hint, s.Pos)
+}
+
+func (s *PseudoGTIDSet) Equal(o mysql.GTIDSet) bool {
+	other, ok := o.(*PseudoGTIDSet)
+	if !ok {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	return s.Hint == other.Hint && s.Pos == other.Pos
+}
+
+// Contain reports whether s is at least as far along as o. Hints embed a
+// hex timestamp (see newPseudoGTIDHint) so they sort chronologically, which
+// lets this work across a binlog rotation or a failover to a replica whose
+// file/pos numbering is unrelated to the old master's.
+func (s *PseudoGTIDSet) Contain(o mysql.GTIDSet) bool {
+	other, ok := o.(*PseudoGTIDSet)
+	if !ok {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	if s.Hint != other.Hint {
+		return s.Hint > other.Hint
+	}
+	return s.Pos.Compare(other.Pos) >= 0
+}
+
+// newPseudoGTIDHint builds the no-op statement Canal injects into the
+// binlog: a DROP VIEW of a view name that encodes a hex timestamp (for
+// chronological ordering) and a random suffix (for uniqueness).
+func newPseudoGTIDHint(prefix string) string {
+	if prefix == "" {
+		prefix = "_pseudo_gtid_hint_"
+	}
+	id := fmt.Sprintf("%x_%08x", time.Now().UnixNano(), rand.Uint32())
+	return fmt.Sprintf("DROP VIEW IF EXISTS `%s%s`", prefix, id)
+}
+
+func (c *Canal) runPseudoGTIDInjector() {
+	defer c.wg.Done()
+
+	cfg := c.cfg.PseudoGTID
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			stmt := newPseudoGTIDHint(cfg.HintPrefix)
+			if _, err := c.Execute(stmt); err != nil {
+				log.Errorf("canal: failed to inject pseudo-GTID hint: %v", err)
+			}
+		}
+	}
+}
+
+// maxTrackedPseudoGTIDHints bounds the in-memory hint->position map so a
+// long-running canal doesn't grow it without limit; hints are injected in
+// chronological order, so evicting the lexicographically smallest key also
+// evicts the oldest one.
+const maxTrackedPseudoGTIDHints = 1000
+
+// handlePseudoGTIDHint recognizes a hint statement Canal (or the DBA) wrote
+// to the binlog and records it, at pos, in the lastHint->position map. It
+// reports whether e was a hint, so the caller can skip ordinary DDL handling
+// for it. It does not itself call OnPosSynced: handleEvent's QueryEvent case
+// does that once, for both hints and ordinary DDL, after this returns.
+func (c *Canal) handlePseudoGTIDHint(e *replication.QueryEvent, pos mysql.Position) bool {
+	if !c.cfg.PseudoGTID.Enabled {
+		return false
+	}
+	prefix := c.cfg.PseudoGTID.HintPrefix
+	if prefix == "" {
+		prefix = "_pseudo_gtid_hint_"
+	}
+
+	query := strings.TrimSpace(string(e.Query))
+	if !strings.HasPrefix(query, "DROP VIEW IF EXISTS") {
+		return false
+	}
+	idx := strings.Index(query, prefix)
+	if idx < 0 {
+		return false
+	}
+
+	hint := strings.TrimRight(query[idx:], "`' \t;")
+	c.recordPseudoGTIDHint(hint, pos)
+
+	return true
+}
+
+// recordPseudoGTIDHint bookmarks hint at pos: it updates lastHint, the
+// hintPositions map (evicting the oldest entry past
+// maxTrackedPseudoGTIDHints), and, if Canal's GTID position is itself a
+// PseudoGTIDSet (i.e. it was started with StartFromPseudoGTID), advances
+// that set too so OnPosSynced reports the hint as Canal's GTID position;
+// OnGTID is not called for hints. Note that ha.go's automatic failover requires a real
+// GTID position and refuses to run against a PseudoGTIDSet; see failover.
+func (c *Canal) recordPseudoGTIDHint(hint string, pos mysql.Position) {
+	c.pseudoGTIDMu.Lock()
+	c.lastHint = hint
+	if c.hintPositions == nil {
+		c.hintPositions = make(map[string]mysql.Position)
+	}
+	c.hintPositions[hint] = pos
+	if len(c.hintPositions) > maxTrackedPseudoGTIDHints {
+		oldest := hint
+		for h := range c.hintPositions {
+			if h < oldest {
+				oldest = h
+			}
+		}
+		delete(c.hintPositions, oldest)
+	}
+	c.pseudoGTIDMu.Unlock()
+
+	c.posMu.Lock()
+	if gs, ok := c.gtidSet.(*PseudoGTIDSet); ok {
+		gs.set(hint, pos)
+	}
+	c.posMu.Unlock()
+}
+
+// StartFromPseudoGTID resumes replication from just after the binlog event
+// carrying hint, scanning the master's binlogs backward from the current
+// one via SHOW BINLOG EVENTS. It lets Canal resume on a master that has no
+// GTID mode, or on a replica whose file/pos numbering bears no relation to
+// where hint was last seen. Canal's GTID position becomes a PseudoGTIDSet
+// bookmarked at hint/pos, which OnPosSynced reports as it would a real
+// mysql.GTIDSet (OnGTID is not called for hints); automatic HA failover (ha.go) is not
+// supported from this position, and must be done manually followed by a
+// fresh call to StartFromPseudoGTID against the new master.
+func (c *Canal) StartFromPseudoGTID(hint string) error {
+	pos, err := c.locatePseudoGTIDHint(hint)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.posMu.Lock()
+	c.gtidSet = NewPseudoGTIDSet(hint, pos)
+	c.master = pos
+	c.posMu.Unlock()
+
+	c.recordPseudoGTIDHint(hint, pos)
+
+	return c.startSyncer(nil, pos)
+}
+
+// locatePseudoGTIDHint walks the retained binlogs newest-first looking for
+// an event whose text contains hint, returning the position of the event
+// right after it. Scanning backward from the newest file means a hint that
+// survived a rotation is still found without having to replay everything
+// since it was written.
+func (c *Canal) locatePseudoGTIDHint(hint string) (mysql.Position, error) {
+	files, err := c.binlogInspector.BinaryLogsNewestFirst()
+	if err != nil {
+		return mysql.Position{}, errors.Trace(err)
+	}
+
+	for _, file := range files {
+		events, err := c.binlogInspector.BinlogEventsNewestFirst(file)
+		if err != nil {
+			return mysql.Position{}, errors.Trace(err)
+		}
+
+		for _, ev := range events {
+			if !strings.Contains(ev.Info, hint) {
+				continue
+			}
+			return mysql.Position{Name: file, Pos: ev.EndLogPos}, nil
+		}
+	}
+
+	return mysql.Position{}, errors.Errorf("canal: pseudo-GTID hint %q not found in any retained binlog", hint)
+}
+
+// binlogEventInfo is the slice of SHOW BINLOG EVENTS columns
+// locatePseudoGTIDHint needs.
+type binlogEventInfo struct {
+	Info      string
+	EndLogPos uint32
+}
+
+// binlogInspector lists the server's retained binlogs and their events.
+// It exists so locatePseudoGTIDHint's backward scan can be driven by a
+// scripted fake in tests instead of a live master (see canal_test.go); the
+// production path is sqlBinlogInspector.
+type binlogInspector interface {
+	BinaryLogsNewestFirst() ([]string, error)
+	BinlogEventsNewestFirst(file string) ([]binlogEventInfo, error)
+}
+
+type sqlBinlogInspector struct {
+	c *Canal
+}
+
+func (b *sqlBinlogInspector) BinaryLogsNewestFirst() ([]string, error) {
+	r, err := b.c.Execute("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	files := make([]string, 0, r.RowNumber())
+	for i := 0; i < r.RowNumber(); i++ {
+		name, err := r.GetStringByName(i, "Log_name")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		files = append(files, name)
+	}
+	for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+	return files, nil
+}
+
+func (b *sqlBinlogInspector) BinlogEventsNewestFirst(file string) ([]binlogEventInfo, error) {
+	r, err := b.c.Execute(fmt.Sprintf("SHOW BINLOG EVENTS IN '%s'", file))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	events := make([]binlogEventInfo, 0, r.RowNumber())
+	for i := r.RowNumber() - 1; i >= 0; i-- {
+		info, _ := r.GetStringByName(i, "Info")
+		endPos, err := r.GetUintByName(i, "End_log_pos")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		events = append(events, binlogEventInfo{Info: info, EndLogPos: uint32(endPos)})
+	}
+	return events, nil
+}